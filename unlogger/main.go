@@ -11,26 +11,54 @@ package main
 
 import (
 	"bufio"
+	"embed"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/vjeantet/grok"
+	"gopkg.in/yaml.v3"
+	"hash/fnv"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+// defaultPatternsFS embeds the built-in grok pattern set shipped with the binary,
+// covering cwltool, Toil, and Cromwell worker logs.
+//
+//go:embed patterns/default.yaml
+var defaultPatternsFS embed.FS
+
 // log errors to stderr
 var logger = log.New(os.Stderr, "", 0)
 
-// find all the files called "worker_log.txt" in the directory tree
+// find all the files called "worker_log.txt" in the directory tree, by draining WalkWorkerLogs
+// into a slice
 func GetWorkerLogs(dirPath string) ([]string, error) {
-	// https://pkg.go.dev/io/fs#FileInfo
-	// https://pkg.go.dev/io/fs#DirEntry
-	// allFiles := []fs.DirEntry{}
+	paths := make(chan string)
+	errc := make(chan error, 1)
+	go WalkWorkerLogs(dirPath, paths, errc)
+
 	allFiles := []string{}
+	for path := range paths {
+		allFiles = append(allFiles, path)
+	}
+	return allFiles, <-errc
+}
+
+// walk the directory tree looking for "worker_log.txt" files, sending each path found on paths
+// as soon as it is discovered instead of buffering the whole tree in memory first.
+// paths is closed once the walk completes; any walk error is sent on errc.
+func WalkWorkerLogs(dirPath string, paths chan<- string, errc chan<- error) {
+	defer close(paths)
 
-	// https://pkg.go.dev/path/filepath#WalkDir
 	err := filepath.WalkDir(dirPath, func(path string, dirEntry fs.DirEntry, err error) error {
 		// skip item that cannot be read
 		if os.IsPermission(err) {
@@ -43,124 +71,446 @@ func GetWorkerLogs(dirPath string) ([]string, error) {
 		}
 
 		if dirEntry.Name() == "worker_log.txt" {
-			allFiles = append(allFiles, path)
+			paths <- path
 		}
 		return err
 	})
-	return allFiles, err
+	errc <- err
 }
 
-// read all the lines from a file
-func ReadLines(path string) []string {
-	file, err := os.Open(path)
+// maxLineBufferCap is the largest single line the scanner will grow its buffer to accommodate.
+// bufio.Scanner starts small and doubles on demand up to this ceiling, so ordinary short lines
+// don't pay for it, but a long JSON-in-log line won't fail the scan outright either.
+const maxLineBufferCap = 64 * 1024 * 1024 // 64Mb
+
+// newLogScanner returns a bufio.Scanner over r with an adaptively-growing line buffer.
+func newLogScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBufferCap)
+	return scanner
+}
+
+func MapHasAllKeys(keys []string, m map[string]string) bool {
+	var result bool = true
+	for _, key := range keys {
+		if _, exists := m[key]; !exists {
+			result = false
+		}
+	}
+	return result
+}
+
+// JobMatch holds every field grok captured from the job line found by FindJobName.
+// It is a struct rather than a positional tuple so that new captured fields (e.g. from
+// future grok patterns) can be added without changing FindJobName's signature.
+type JobMatch struct {
+	Found       bool
+	Jobname     string
+	Path        string // the path value captured from inside the log line, before the log may have been moved
+	Timestamp   string
+	PatternName string // name of the NamedPattern that matched
+}
+
+// NamedPattern is one grok pattern FindJobName tries, identified by Name so callers can tell
+// which pattern matched. Aux holds auxiliary building-block patterns (registered into the grok
+// instance via Grok.AddPattern) that Pattern may reference.
+type NamedPattern struct {
+	Name    string            `yaml:"name" json:"name"`
+	Pattern string            `yaml:"pattern" json:"pattern"`
+	Aux     map[string]string `yaml:"aux,omitempty" json:"aux,omitempty"`
+}
+
+// parsePatterns decodes an ordered list of NamedPatterns from YAML (or JSON, which is valid YAML).
+func parsePatterns(data []byte) ([]NamedPattern, error) {
+	var patterns []NamedPattern
+	if err := yaml.Unmarshal(data, &patterns); err != nil {
+		return nil, fmt.Errorf("couldn't parse patterns: %w", err)
+	}
+	return patterns, nil
+}
+
+// LoadDefaultPatterns returns the built-in pattern set embedded in the binary.
+func LoadDefaultPatterns() ([]NamedPattern, error) {
+	data, err := defaultPatternsFS.ReadFile("patterns/default.yaml")
 	if err != nil {
-		logger.Fatalln("Couldn't open the file", err)
+		return nil, err
 	}
-	defer file.Close()
+	return parsePatterns(data)
+}
+
+// LoadPatterns reads an ordered list of NamedPatterns from a YAML or JSON file at path.
+func LoadPatterns(path string) ([]NamedPattern, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read patterns file %q: %w", path, err)
+	}
+	return parsePatterns(data)
+}
 
-	var lines []string
+// buildGrok constructs a single Grok instance for the given patterns: it registers each
+// pattern's aux building blocks and validates that every pattern compiles, so a malformed
+// pattern is caught here rather than mid-run inside a worker. Grok guards its internal
+// caches with its own mutexes, so the returned instance is safe to share read-only across
+// worker goroutines instead of rebuilding one (and re-registering aux patterns) per file
+// scanned.
+func buildGrok(patterns []NamedPattern) (*grok.Grok, error) {
+	g, err := grok.NewWithConfig(&grok.Config{NamedCapturesOnly: true})
+	if err != nil {
+		return nil, err
+	}
 
-	// need to initialize a buffer for the scanner that is larger than the default 64KB size
-	const maxCapacity = 2048 * 1024 // 2Mb
-	buf := make([]byte, maxCapacity)
-	scanner := bufio.NewScanner(file) // file io.Reader
-	scanner.Buffer(buf, maxCapacity)
-	for scanner.Scan() {
-		var line string
-		line = scanner.Text()
+	for _, p := range patterns {
+		for name, auxPattern := range p.Aux {
+			if err := g.AddPattern(name, auxPattern); err != nil {
+				return nil, fmt.Errorf("pattern %q: couldn't register aux pattern %q: %w", p.Name, name, err)
+			}
+		}
+	}
 
-		if len(line) > 0 { // && string(line[0]) == string(commentChar)
-			lines = append(lines, line)
-		} else {
-			break
+	for _, p := range patterns {
+		if _, err := g.Parse(p.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p.Name, err)
 		}
+	}
+
+	return g, nil
+}
 
+// search the lines read from scanner for the line that gives the job name, trying patterns in
+// order against each line, and return as soon as one matches. Scans at most maxLines lines
+// (maxLines<=0 means unlimited) before giving up, so a huge log without a job line doesn't get
+// scanned in full. g must already have every pattern's aux building blocks registered and
+// validated (see buildGrok) and may be shared across concurrent calls.
+func FindJobName(scanner *bufio.Scanner, g *grok.Grok, patterns []NamedPattern, maxLines int) JobMatch {
+	for lineNum := 0; (maxLines <= 0 || lineNum < maxLines) && scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+
+		for _, p := range patterns {
+			// [2022-08-23T14:13:06-0400] [MainThread] [I] [foobar] [job some_job_name] /path/to/foo$ command \
+			values, err := g.Parse(p.Pattern, line)
+			if err != nil {
+				// buildGrok validates every pattern compiles before the worker pool starts,
+				// so this is unreachable in practice; treat it as no match rather than
+				// Fatal-ing a worker mid-run
+				continue
+			}
+
+			if !MapHasAllKeys([]string{"jobname"}, values) {
+				continue
+			}
+
+			// grok pulls in trailing '$' by default, need to remove
+			path := strings.Trim(values["path"], "$")
+
+			return JobMatch{
+				Found:       true,
+				Jobname:     values["jobname"],
+				Path:        path,
+				Timestamp:   values["timestamp"],
+				PatternName: p.Name,
+			}
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		logger.Fatal(err)
+
+	return JobMatch{Found: false}
+}
+
+// 'touch' a file to create it
+func TouchFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("couldn't touch %q: %w", path, err)
 	}
+	return f.Close()
+}
 
-	return lines
+// jobResult is the outcome of scanning a single worker_log.txt path
+type jobResult struct {
+	logPath     string // path to the worker_log.txt that was scanned
+	jobDir      string // dirname(logPath); do not use the path from inside the log in case it was moved
+	jobFilePath string // path to the label file stub that was (or would be) created
+	match       JobMatch
+	duration    time.Duration
+	err         error
 }
 
-func MapHasAllKeys(keys []string, m map[string]string) bool {
-	var result bool = true
-	for _, key := range keys {
-		if _, exists := m[key]; !exists {
-			result = false
+// scanWorkerLog reads a worker_log.txt, looks for the jobname line, and (unless touch is false)
+// touches the label file stub
+func scanWorkerLog(path string, touch bool, g *grok.Grok, patterns []NamedPattern, maxLines int) jobResult {
+	start := time.Now()
+
+	jobDirPath := filepath.Dir(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return jobResult{logPath: path, jobDir: jobDirPath, err: fmt.Errorf("couldn't open the file %q: %w", path, err), duration: time.Since(start)}
+	}
+	defer file.Close()
+
+	scanner := newLogScanner(file)
+	match := FindJobName(scanner, g, patterns, maxLines)
+	if err := scanner.Err(); err != nil {
+		return jobResult{logPath: path, jobDir: jobDirPath, err: fmt.Errorf("error scanning %q: %w", path, err), duration: time.Since(start)}
+	}
+
+	result := jobResult{logPath: path, jobDir: jobDirPath, match: match}
+
+	if !match.Found {
+		result.duration = time.Since(start)
+		return result
+	}
+
+	jobFilePath := filepath.Join(jobDirPath, match.Jobname)
+	result.jobFilePath = jobFilePath
+
+	if touch {
+		if err := TouchFile(jobFilePath); err != nil {
+			result.err = err
 		}
 	}
+
+	result.duration = time.Since(start)
 	return result
 }
 
-// search for the line that gives the job name
-// return results from first line that has the values
-func FindJobName(lines []string) (bool, string, string) {
-	g, _ := grok.NewWithConfig(&grok.Config{NamedCapturesOnly: true})
+// ManifestRecord is one structured record written to the -manifest output for each worker_log.txt
+// discovered. Error is set (and Found is false) when the log couldn't be scanned at all, so a
+// consumer of the manifest can tell "this log had a read/scan error" apart from "this log was
+// never discovered".
+type ManifestRecord struct {
+	LogPath     string `json:"log_path"`
+	JobDir      string `json:"job_dir"`
+	Jobname     string `json:"jobname"`
+	Timestamp   string `json:"timestamp"`
+	Path        string `json:"path"`
+	PatternName string `json:"pattern_name"`
+	Found       bool   `json:"found"`
+	Error       string `json:"error,omitempty"`
+}
+
+var manifestTSVHeader = []string{"log_path", "job_dir", "jobname", "timestamp", "path", "pattern_name", "found", "error"}
 
-	var found bool = false
-	for _, line := range lines {
-		// [2022-08-23T14:13:06-0400] [MainThread] [I] [foobar] [job some_job_name] /path/to/foo$ command \
-		values, err := g.Parse(`^\[%{TIMESTAMP_ISO8601:timestamp}\].*\[job %{WORD:jobname}.*\] %{PATH:path}`, line)
-		if err != nil {
-			logger.Fatal(err) // fmt.Printf("ERROR: %v\n", err) // return err
+// manifestWriter serializes ManifestRecords to w in either "json" (newline-delimited) or "tsv" format.
+type manifestWriter struct {
+	w           io.Writer
+	format      string
+	wroteHeader bool
+}
+
+func newManifestWriter(w io.Writer, format string) *manifestWriter {
+	return &manifestWriter{w: w, format: format}
+}
+
+func (mw *manifestWriter) Write(rec ManifestRecord) error {
+	if mw.format == "tsv" {
+		if !mw.wroteHeader {
+			if _, err := fmt.Fprintln(mw.w, strings.Join(manifestTSVHeader, "\t")); err != nil {
+				return err
+			}
+			mw.wroteHeader = true
 		}
+		_, err := fmt.Fprintf(mw.w, "%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\n", rec.LogPath, rec.JobDir, rec.Jobname, rec.Timestamp, rec.Path, rec.PatternName, rec.Found, rec.Error)
+		return err
+	}
 
-		if MapHasAllKeys([]string{"jobname", "path"}, values) {
-			found = true
-			jobname := values["jobname"]
-			path := values["path"]
+	return json.NewEncoder(mw.w).Encode(rec)
+}
 
-			// grok pulls in trailing '$' by default, need to remove
-			path = strings.Trim(path, "$")
+// pathProducer sends worker_log.txt paths to process on paths, closing it when done,
+// and reports any error encountered producing the paths on errc.
+type pathProducer func(paths chan<- string, errc chan<- error)
 
-			return found, jobname, path
+// feedPaths sends an already-resolved list of paths (e.g. one shard's worth) to out.
+func feedPaths(resolved []string, out chan<- string, errc chan<- error) {
+	defer close(out)
+	for _, path := range resolved {
+		out <- path
+	}
+	errc <- nil
+}
 
-		}
+// selectShard sorts paths into a deterministic order and keeps only those belonging to shard,
+// out of shards total shards, by hashing each path with fnv.New32. shards<=0 disables sharding
+// and returns every path in sorted order.
+func selectShard(paths []string, shard int, shards int) []string {
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+
+	if shards <= 0 {
+		return sorted
 	}
 
-	return found, "", ""
+	var selected []string
+	for _, path := range sorted {
+		h := fnv.New32()
+		h.Write([]byte(path))
+		if int(h.Sum32()%uint32(shards)) == shard {
+			selected = append(selected, path)
+		}
+	}
+	return selected
 }
 
-// 'touch' a file to create it
-func TouchFile(path string) {
-	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
-	defer f.Close()
+// absOrSelf returns the absolute form of path, or path unchanged if it couldn't be resolved
+// (e.g. the working directory can't be determined), so a manifest record doesn't mix absolute and relative forms depending
+// on whether the user passed a relative start dir.
+func absOrSelf(path string) string {
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		logger.Fatal(err)
+		return path
 	}
+	return abs
+}
+
+// runWorkerPool fans worker_log.txt paths from produce out to numWorkers goroutines,
+// printing each resolved label file path as it is produced (and, if manifest is non-nil,
+// writing a ManifestRecord for every log discovered, including ones that errored), and
+// returns any errors encountered.
+func runWorkerPool(produce pathProducer, numWorkers int, verbose bool, touch bool, manifest *manifestWriter, g *grok.Grok, patterns []NamedPattern, maxLines int) []error {
+	paths := make(chan string)
+	walkErrc := make(chan error, 1)
+	go produce(paths, walkErrc)
+
+	results := make(chan jobResult)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				results <- scanWorkerLog(path, touch, g, patterns, maxLines)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// collector: serialize stdout output and manifest writes so concurrent workers don't interleave them
+	var errs []error
+	for result := range results {
+		if verbose {
+			logger.Printf("%v: %v (found=%v)\n", result.logPath, result.duration, result.match.Found)
+		}
+		if result.err != nil {
+			errs = append(errs, result.err)
+		} else if result.match.Found {
+			fmt.Printf("%v\n", result.jobFilePath)
+		}
+		if manifest != nil {
+			rec := ManifestRecord{
+				LogPath:     absOrSelf(result.logPath),
+				JobDir:      absOrSelf(result.jobDir),
+				Jobname:     result.match.Jobname,
+				Timestamp:   result.match.Timestamp,
+				Path:        result.match.Path,
+				PatternName: result.match.PatternName,
+				Found:       result.match.Found,
+			}
+			if result.err != nil {
+				rec.Error = result.err.Error()
+			}
+			if err := manifest.Write(rec); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if walkErr := <-walkErrc; walkErr != nil {
+		errs = append(errs, walkErr)
+	}
+
+	return errs
 }
 
 func main() {
-	var startDir string
-	args := os.Args[1:]
-	if len(args) < 1 {
-		logger.Fatal("ERROR: You need to supply a start dir")
-	} else {
-		startDir = args[0]
+	numWorkers := flag.Int("n", runtime.NumCPU(), "number of worker goroutines to scan logs with")
+	verbose := flag.Bool("v", false, "report per-file scan timings")
+	shard := flag.Int("shard", 0, "which shard this invocation processes, in [0, shards)")
+	shards := flag.Int("shards", 0, "total number of shards to split the work across; 0 disables sharding")
+	manifestPath := flag.String("manifest", "", "write a structured manifest of jobname<->workdir mappings to this path")
+	format := flag.String("format", "json", "manifest format: \"json\" (newline-delimited) or \"tsv\"")
+	noTouch := flag.Bool("no-touch", false, "skip creating jobname label file stubs")
+	patternsPath := flag.String("patterns", "", "load additional grok patterns from this YAML/JSON file, tried before the built-in defaults")
+	listPatterns := flag.Bool("list-patterns", false, "print the patterns that would be used, in match order, and exit")
+	maxLines := flag.Int("max-lines", 500, "give up looking for the jobname line after this many lines of a log; <=0 means unlimited")
+	flag.Parse()
+
+	defaultPatterns, err := LoadDefaultPatterns()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	patterns := defaultPatterns
+	if *patternsPath != "" {
+		userPatterns, err := LoadPatterns(*patternsPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		patterns = append(userPatterns, defaultPatterns...)
 	}
 
-	// find all log files
-	allFiles, err := GetWorkerLogs(startDir)
+	if *listPatterns {
+		for _, p := range patterns {
+			fmt.Printf("%v\t%v\n", p.Name, p.Pattern)
+		}
+		return
+	}
+
+	// build and validate the shared Grok instance up front, so a malformed pattern is
+	// reported cleanly here instead of Fatal-ing mid-run inside a worker goroutine
+	g, err := buildGrok(patterns)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	for _, path := range allFiles {
-		// read all the lines from each file
-		allLines := ReadLines(path)
+	args := flag.Args()
+	if len(args) < 1 {
+		logger.Fatal("ERROR: You need to supply a start dir")
+	}
+	startDir := args[0]
+
+	if *numWorkers < 1 {
+		*numWorkers = 1
+	}
+	if *shards > 0 && (*shard < 0 || *shard >= *shards) {
+		logger.Fatalf("ERROR: -shard must be in [0, %d) when -shards=%d", *shards, *shards)
+	}
+	if *format != "json" && *format != "tsv" {
+		logger.Fatalf("ERROR: -format must be \"json\" or \"tsv\", got %q", *format)
+	}
+
+	var manifest *manifestWriter
+	if *manifestPath != "" {
+		f, err := os.Create(*manifestPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer f.Close()
+		manifest = newManifestWriter(f, *format)
+	}
 
-		// search the lines for the jobname
-		found, jobname, _ := FindJobName(allLines)
+	var produce pathProducer
+	if *shards > 0 {
+		allFiles, err := GetWorkerLogs(startDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		myShard := selectShard(allFiles, *shard, *shards)
+		produce = func(paths chan<- string, errc chan<- error) {
+			feedPaths(myShard, paths, errc)
+		}
+	} else {
+		produce = func(paths chan<- string, errc chan<- error) {
+			WalkWorkerLogs(startDir, paths, errc)
+		}
+	}
 
-		if found {
-			// make path to jobname file ; dirname(path)/jobname
-			jobDirPath := filepath.Dir(path) // jobDirPath := filepath.Dir(jobpath) // do not use the path from inside the log in case we moved the log
-			jobFilePath := filepath.Join(jobDirPath, jobname)
-			// print the path of the file we will create
-			fmt.Printf("%v\n", jobFilePath)
-			// create a file stub to label the dir contents
-			TouchFile(jobFilePath)
+	errs := runWorkerPool(produce, *numWorkers, *verbose, !*noTouch, manifest, g, patterns, *maxLines)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logger.Println(err)
 		}
+		os.Exit(1)
 	}
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -33,48 +38,281 @@ func TestMapHasKeys(t *testing.T) {
 	}
 }
 
+var cwltoolPattern = NamedPattern{
+	Name:    "cwltool",
+	Pattern: `^\[%{TIMESTAMP_ISO8601:timestamp}\].*\[job %{WORD:jobname}.*\] %{PATH:path}`,
+}
+
+const jobLine = "[2020-07-13T04:10:16-0400] [MainThread] [I] [cwltool] [job maf2vcf] /path/to/foo$ command"
+
 func TestFindJobName(t *testing.T) {
-	type Result struct {
-		Found   bool
-		Jobname string
-		Path    string
-	}
 	tests := map[string]struct {
-		inputLines []string
-		want       Result
+		inputText string
+		patterns  []NamedPattern
+		maxLines  int
+		want      JobMatch
 	}{
-		"first": {
-			inputLines: []string{
-				"a",
-				"[2020-07-13T04:10:16-0400] [MainThread] [I] [cwltool] [job maf2vcf] /path/to/foo$ command",
-				"b",
+		"match on line 1": {
+			inputText: jobLine + "\n" + "b\n",
+			patterns:  []NamedPattern{cwltoolPattern},
+			want: JobMatch{
+				Found:       true,
+				Jobname:     "maf2vcf",
+				Path:        "/path/to/foo",
+				Timestamp:   "2020-07-13T04:10:16-0400",
+				PatternName: "cwltool",
 			},
-			want: Result{
-				Found:   true,
-				Jobname: "maf2vcf",
-				Path:    "/path/to/foo",
+		},
+		"no match": {
+			inputText: "a\nc\nb\n",
+			patterns:  []NamedPattern{cwltoolPattern},
+			want:      JobMatch{Found: false},
+		},
+		"mid-stream blank lines don't truncate the scan": {
+			inputText: "a\n\n\nb\n" + jobLine + "\n",
+			patterns:  []NamedPattern{cwltoolPattern},
+			want: JobMatch{
+				Found:       true,
+				Jobname:     "maf2vcf",
+				Path:        "/path/to/foo",
+				Timestamp:   "2020-07-13T04:10:16-0400",
+				PatternName: "cwltool",
 			},
 		},
-		"second": {
-			inputLines: []string{
-				"a",
-				"c",
-				"b",
+		"match after a very long preceding line": {
+			inputText: strings.Repeat("x", 3*1024*1024) + "\n" + jobLine + "\n",
+			patterns:  []NamedPattern{cwltoolPattern},
+			want: JobMatch{
+				Found:       true,
+				Jobname:     "maf2vcf",
+				Path:        "/path/to/foo",
+				Timestamp:   "2020-07-13T04:10:16-0400",
+				PatternName: "cwltool",
 			},
-			want: Result{
-				Found:   false,
-				Jobname: "",
-				Path:    "",
+		},
+		"no match within max-lines gives up": {
+			inputText: "a\nb\n" + jobLine + "\n",
+			patterns:  []NamedPattern{cwltoolPattern},
+			maxLines:  2,
+			want:      JobMatch{Found: false},
+		},
+		"falls through to a later pattern when an earlier one doesn't match": {
+			inputText: "Job 1234-abcd maf2vcf\n",
+			patterns: []NamedPattern{
+				cwltoolPattern,
+				{
+					Name:    "toil-worker",
+					Aux:     map[string]string{"TOILJOBID": `[0-9a-zA-Z_./:-]+`},
+					Pattern: `^Job %{TOILJOBID:jobid} %{WORD:jobname}`,
+				},
+			},
+			want: JobMatch{
+				Found:       true,
+				Jobname:     "maf2vcf",
+				PatternName: "toil-worker",
 			},
 		},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			gotFound, gotJobname, gotPath := FindJobName(tc.inputLines)
-			if diff := cmp.Diff(tc.want, Result{gotFound, gotJobname, gotPath}); diff != "" {
+			g, err := buildGrok(tc.patterns)
+			if err != nil {
+				t.Fatalf("unexpected error building grok: %v", err)
+			}
+			scanner := newLogScanner(strings.NewReader(tc.inputText))
+			got := FindJobName(scanner, g, tc.patterns, tc.maxLines)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
 				t.Errorf("got vs want mismatch (-want +got):\n%s", diff)
 			}
+			if err := scanner.Err(); err != nil {
+				t.Errorf("unexpected scanner error: %v", err)
+			}
 		})
 	}
 }
+
+func TestBuildGrok(t *testing.T) {
+	t.Run("valid patterns compile", func(t *testing.T) {
+		if _, err := buildGrok([]NamedPattern{cwltoolPattern}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("undefined capture is rejected up front", func(t *testing.T) {
+		_, err := buildGrok([]NamedPattern{{Name: "bogus", Pattern: `%{NOSUCHPATTERN:jobname}`}})
+		if err == nil {
+			t.Fatal("expected an error for a pattern referencing an undefined capture, got nil")
+		}
+	})
+}
+
+// TestRunWorkerPool exercises the worker pool against a small fixture: one valid
+// worker_log.txt that matches, and one path that doesn't exist. It confirms a per-file
+// error is collected rather than aborting the run, that the valid file is still fully
+// processed (its label file stub gets created), and that both logs get a manifest record
+// (the errored one with found=false and its error text set, not simply dropped).
+func TestRunWorkerPool(t *testing.T) {
+	dir := t.TempDir()
+	jobDir := filepath.Join(dir, "job1")
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logPath := filepath.Join(jobDir, "worker_log.txt")
+	if err := os.WriteFile(logPath, []byte(jobLine+"\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	missingPath := filepath.Join(dir, "does-not-exist", "worker_log.txt")
+
+	patterns := []NamedPattern{cwltoolPattern}
+	g, err := buildGrok(patterns)
+	if err != nil {
+		t.Fatalf("unexpected error building grok: %v", err)
+	}
+
+	produce := func(paths chan<- string, errc chan<- error) {
+		feedPaths([]string{logPath, missingPath}, paths, errc)
+	}
+
+	var buf strings.Builder
+	manifest := newManifestWriter(&buf, "json")
+
+	errs := runWorkerPool(produce, 2, false, true, manifest, g, patterns, 500)
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly one error, got %d: %v", len(errs), errs)
+	}
+
+	labelPath := filepath.Join(jobDir, "maf2vcf")
+	if _, err := os.Stat(labelPath); err != nil {
+		t.Errorf("expected label file %q for the matching log to be created: %v", labelPath, err)
+	}
+
+	records := decodeManifestRecords(t, buf.String())
+	if len(records) != 2 {
+		t.Fatalf("expected a manifest record for both logs, got %d: %+v", len(records), records)
+	}
+	byPath := map[string]ManifestRecord{}
+	for _, rec := range records {
+		byPath[rec.LogPath] = rec
+	}
+
+	errored, ok := byPath[absOrSelf(missingPath)]
+	if !ok {
+		t.Fatalf("expected a manifest record for the missing path, got %+v", records)
+	}
+	if errored.Found || errored.Error == "" {
+		t.Errorf("expected the missing path's record to have found=false and a non-empty error, got %+v", errored)
+	}
+
+	matched, ok := byPath[absOrSelf(logPath)]
+	if !ok {
+		t.Fatalf("expected a manifest record for the matching log, got %+v", records)
+	}
+	if !matched.Found || matched.Error != "" {
+		t.Errorf("expected the matching log's record to have found=true and no error, got %+v", matched)
+	}
+}
+
+// decodeManifestRecords decodes newline-delimited JSON manifest records.
+func decodeManifestRecords(t *testing.T, data string) []ManifestRecord {
+	t.Helper()
+	var records []ManifestRecord
+	dec := json.NewDecoder(strings.NewReader(data))
+	for dec.More() {
+		var rec ManifestRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("unexpected error decoding manifest record: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestLoadDefaultPatterns(t *testing.T) {
+	patterns, err := LoadDefaultPatterns()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(patterns) == 0 {
+		t.Fatal("expected at least one default pattern, got none")
+	}
+	for _, p := range patterns {
+		if p.Name == "" || p.Pattern == "" {
+			t.Errorf("pattern %+v is missing a name or pattern", p)
+		}
+	}
+}
+
+func TestSelectShard(t *testing.T) {
+	paths := []string{
+		"/work/job3/worker_log.txt",
+		"/work/job1/worker_log.txt",
+		"/work/job2/worker_log.txt",
+		"/work/job4/worker_log.txt",
+	}
+
+	t.Run("shards=0 disables sharding and just sorts", func(t *testing.T) {
+		want := []string{
+			"/work/job1/worker_log.txt",
+			"/work/job2/worker_log.txt",
+			"/work/job3/worker_log.txt",
+			"/work/job4/worker_log.txt",
+		}
+		got := selectShard(paths, 0, 0)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("got vs want mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("shards partition the full list exactly once each", func(t *testing.T) {
+		const shards = 3
+		var union []string
+		for shard := 0; shard < shards; shard++ {
+			union = append(union, selectShard(paths, shard, shards)...)
+		}
+		sort.Strings(union)
+
+		want := selectShard(paths, 0, 0)
+		if diff := cmp.Diff(want, union); diff != "" {
+			t.Errorf("union of shards did not reproduce the full sorted path list (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestManifestWriter(t *testing.T) {
+	rec := ManifestRecord{
+		LogPath:     "/work/job1/worker_log.txt",
+		JobDir:      "/work/job1",
+		Jobname:     "maf2vcf",
+		Timestamp:   "2020-07-13T04:10:16-0400",
+		Path:        "/path/to/foo",
+		PatternName: "cwltool",
+		Found:       true,
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var buf strings.Builder
+		mw := newManifestWriter(&buf, "json")
+		if err := mw.Write(rec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := `{"log_path":"/work/job1/worker_log.txt","job_dir":"/work/job1","jobname":"maf2vcf","timestamp":"2020-07-13T04:10:16-0400","path":"/path/to/foo","pattern_name":"cwltool","found":true}` + "\n"
+		if diff := cmp.Diff(want, buf.String()); diff != "" {
+			t.Errorf("got vs want mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("tsv", func(t *testing.T) {
+		var buf strings.Builder
+		mw := newManifestWriter(&buf, "tsv")
+		if err := mw.Write(rec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "log_path\tjob_dir\tjobname\ttimestamp\tpath\tpattern_name\tfound\terror\n" +
+			"/work/job1/worker_log.txt\t/work/job1\tmaf2vcf\t2020-07-13T04:10:16-0400\t/path/to/foo\tcwltool\ttrue\t\n"
+		if diff := cmp.Diff(want, buf.String()); diff != "" {
+			t.Errorf("got vs want mismatch (-want +got):\n%s", diff)
+		}
+	})
+}